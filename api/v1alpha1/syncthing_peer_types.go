@@ -0,0 +1,57 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package v1alpha1
+
+// SyncthingPeer represents a remote Syncthing device that this mover's
+// Syncthing instance should connect and share folders with.
+type SyncthingPeer struct {
+	// ID is the Syncthing device ID of the peer, as reported by the peer's
+	// own Syncthing instance (Actions -> Show ID).
+	ID string `json:"ID"`
+
+	// Addresses is the list of addresses Syncthing should dial in order to
+	// reach this peer. Each entry may be a bare "host:port" (treated as
+	// "tcp://host:port" for backwards compatibility), or a fully-qualified
+	// address using one of Syncthing's supported schemes: "tcp://",
+	// "quic://", "relay://", "dynamic+https://<discovery-endpoint>", or the
+	// bare "dynamic" sentinel, which enables global/local discovery for this
+	// device instead of dialing a fixed address.
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Introducer marks the peer as an introducer: devices that this peer is
+	// connected to will automatically be shared with us as well.
+	// +optional
+	Introducer bool `json:"introducer,omitempty"`
+
+	// AllowedNetworks restricts which subnets Syncthing may use when dialing or
+	// accepting connections to/from this peer, given as a list of CIDRs (e.g.
+	// "10.0.0.0/8", "192.168.1.0/24"). When set, traffic to this peer cannot
+	// fall back to a public relay or an unintended network path. Leave empty
+	// to allow any network. Each entry must be a valid CIDR; an invalid entry
+	// fails reconcile with an error naming the offending peer and entry, which
+	// callers are expected to surface however they report reconcile failures.
+	// +optional
+	AllowedNetworks []string `json:"allowedNetworks,omitempty"`
+
+	// Compression controls which messages exchanged with this peer are
+	// compressed. One of "metadata", "always", or "never". Defaults to
+	// "metadata" if unset, matching Syncthing's own default.
+	// +optional
+	// +kubebuilder:validation:Enum=metadata;always;never
+	Compression string `json:"compression,omitempty"`
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package v1alpha1
+
+// SyncthingPeerStatus records what we last observed about a connected peer,
+// so that a later reconcile can tell whether its Syncthing process has
+// restarted since.
+type SyncthingPeerStatus struct {
+	// ID is the Syncthing device ID of the peer this status is for.
+	ID string `json:"ID"`
+
+	// InstanceID identifies the specific run of the peer's Syncthing process
+	// we last observed. It changes whenever that peer's process restarts,
+	// even though its device ID stays the same.
+	InstanceID string `json:"instanceID,omitempty"`
+}
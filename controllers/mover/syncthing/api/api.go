@@ -0,0 +1,240 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package api provides a thin client for talking to a running Syncthing
+// instance's REST API from within the VolSync syncthing mover.
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// APIConfig holds what's needed to reach the local Syncthing instance's REST API.
+type APIConfig struct {
+	// APIKey is sent as the X-API-Key header on every request.
+	APIKey string
+	// Endpoint is the base URL of the Syncthing REST API, e.g. "https://127.0.0.1:8384".
+	Endpoint string
+}
+
+// Syncthing wraps a connection to a running Syncthing instance's REST API,
+// together with the most recently fetched copy of its configuration.
+type Syncthing struct {
+	// Configuration is the most recently fetched Syncthing configuration.
+	Configuration config.Configuration
+
+	// DeviceID is this Syncthing instance's own device ID.
+	DeviceID protocol.DeviceID
+
+	// InstanceID uniquely identifies this run of the local Syncthing process.
+	// It is generated once at startup and included in our announced device
+	// name, so that remote peers can recognize a restart from the name alone,
+	// the same way Syncthing's own local discovery protocol does.
+	InstanceID string
+
+	// APIConfig holds the credentials and address used to reach the local
+	// Syncthing REST API.
+	APIConfig APIConfig
+
+	client *http.Client
+}
+
+// Connection describes a single entry from Syncthing's
+// "/rest/system/connections" endpoint for one remote device.
+type Connection struct {
+	ClientVersion string    `json:"clientVersion"`
+	StartedAt     time.Time `json:"startedAt"`
+	Connected     bool      `json:"connected"`
+}
+
+// systemConnectionsResponse mirrors the JSON body returned by
+// "/rest/system/connections": a map of device ID to Connection, alongside a
+// "total" summary entry that callers can ignore.
+type systemConnectionsResponse struct {
+	Connections map[string]Connection `json:"connections"`
+}
+
+// DeviceDelta describes the minimal set of changes needed to bring Syncthing's
+// running device list in line with a desired one: devices to add, devices to
+// update in place, and devices to remove entirely.
+type DeviceDelta struct {
+	Add    []config.DeviceConfiguration
+	Update []config.DeviceConfiguration
+	Remove []protocol.DeviceID
+}
+
+// Empty reports whether the delta requires no changes at all.
+func (d DeviceDelta) Empty() bool {
+	return len(d.Add) == 0 && len(d.Update) == 0 && len(d.Remove) == 0
+}
+
+// MyID returns this Syncthing instance's own device ID, as a string.
+func (s *Syncthing) MyID() string {
+	return s.DeviceID.GoString()
+}
+
+// ShareFoldersWithDevices updates the Configuration's folders so that each
+// folder is shared with exactly the given set of devices.
+func (s *Syncthing) ShareFoldersWithDevices(devices []config.DeviceConfiguration) {
+	folderDevices := make([]config.FolderDeviceConfiguration, 0, len(devices))
+	for _, device := range devices {
+		folderDevices = append(folderDevices, config.FolderDeviceConfiguration{DeviceID: device.DeviceID})
+	}
+	for i := range s.Configuration.Folders {
+		s.Configuration.Folders[i].Devices = folderDevices
+	}
+}
+
+// SystemConnections fetches the current state of every device connection
+// known to the local Syncthing instance, keyed by device ID.
+func (s *Syncthing) SystemConnections() (map[string]Connection, error) {
+	var resp systemConnectionsResponse
+	if err := s.get("/rest/system/connections", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Connections, nil
+}
+
+// ApplyConfiguration pushes the in-memory Configuration to the local
+// Syncthing instance via its REST API.
+func (s *Syncthing) ApplyConfiguration() error {
+	return s.patch("/rest/config", s.Configuration)
+}
+
+// ApplyOptions pushes the in-memory Options -- most notably our listen
+// addresses -- to the local Syncthing instance via its dedicated REST
+// endpoint, without touching devices or folders.
+func (s *Syncthing) ApplyOptions() error {
+	return s.put("/rest/config/options", s.Configuration.Options)
+}
+
+// ApplyFolders pushes the in-memory folder list -- most notably which devices
+// each folder is shared with -- to the local Syncthing instance via its
+// dedicated REST endpoint, without touching devices or options.
+func (s *Syncthing) ApplyFolders() error {
+	return s.put("/rest/config/folders", s.Configuration.Folders)
+}
+
+// ApplyDeviceDelta pushes only the devices named in delta to the local
+// Syncthing instance, via its per-device REST endpoints, instead of replacing
+// the entire device list on every reconcile. This keeps the cost of a
+// reconcile proportional to the number of devices that changed, rather than
+// to the total size of the mesh.
+func (s *Syncthing) ApplyDeviceDelta(delta DeviceDelta) error {
+	for _, device := range delta.Add {
+		if err := s.put(devicePath(device.DeviceID), device); err != nil {
+			return fmt.Errorf("adding device %s: %w", device.DeviceID, err)
+		}
+	}
+	for _, device := range delta.Update {
+		if err := s.put(devicePath(device.DeviceID), device); err != nil {
+			return fmt.Errorf("updating device %s: %w", device.DeviceID, err)
+		}
+	}
+	for _, id := range delta.Remove {
+		if err := s.delete(devicePath(id)); err != nil {
+			return fmt.Errorf("removing device %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// devicePath builds the per-device REST endpoint used to add, update, or
+// remove a single device without touching the rest of the configuration.
+func devicePath(id protocol.DeviceID) string {
+	return "/rest/config/devices/" + id.String()
+}
+
+// httpClient returns the client used to talk to the Syncthing REST API,
+// lazily initializing a default one if the caller didn't provide one.
+func (s *Syncthing) httpClient() *http.Client {
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return s.client
+}
+
+func (s *Syncthing) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, s.APIConfig.Endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", s.APIConfig.APIKey)
+
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("syncthing API GET %s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *Syncthing) patch(path string, body interface{}) error {
+	return s.send(http.MethodPatch, path, body)
+}
+
+func (s *Syncthing) put(path string, body interface{}) error {
+	return s.send(http.MethodPut, path, body)
+}
+
+func (s *Syncthing) delete(path string) error {
+	return s.send(http.MethodDelete, path, nil)
+}
+
+func (s *Syncthing) send(method, path string, body interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, s.APIConfig.Endpoint+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", s.APIConfig.APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("syncthing API %s %s: unexpected status %s", method, path, resp.Status)
+	}
+	return nil
+}
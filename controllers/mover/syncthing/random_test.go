@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package syncthing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateRandomStringNoForbiddenCharacters(t *testing.T) {
+	s, err := GenerateRandomString(10000)
+	if err != nil {
+		t.Fatalf("GenerateRandomString() returned error: %v", err)
+	}
+	if len(s) != 10000 {
+		t.Fatalf("GenerateRandomString() returned %d characters, want 10000", len(s))
+	}
+	for _, r := range s {
+		if r < '!' || r > '~' {
+			t.Fatalf("GenerateRandomString() produced forbidden character %q", r)
+		}
+	}
+}
+
+func TestGenerateRandomStringFromAlphabetNoForbiddenCharacters(t *testing.T) {
+	const alphabet = "0123456789abcdef"
+	s, err := GenerateRandomStringFromAlphabet(10000, alphabet)
+	if err != nil {
+		t.Fatalf("GenerateRandomStringFromAlphabet() returned error: %v", err)
+	}
+	for _, r := range s {
+		if !strings.ContainsRune(alphabet, r) {
+			t.Fatalf("GenerateRandomStringFromAlphabet() produced forbidden character %q", r)
+		}
+	}
+}
+
+func TestGenerateRandomStringFromAlphabetRejectsEmptyAlphabet(t *testing.T) {
+	if _, err := GenerateRandomStringFromAlphabet(10, ""); err == nil {
+		t.Fatal("GenerateRandomStringFromAlphabet() with empty alphabet: want error, got nil")
+	}
+}
+
+// TestGenerateRandomStringFromAlphabetUniform verifies that, over a large sample,
+// each character of the alphabet is drawn with roughly equal frequency using a
+// chi-squared goodness-of-fit test. A biased mapping (e.g. a plain modulo onto a
+// non-power-of-two alphabet) would skew the first few characters and fail this
+// check well before the critical value below.
+func TestGenerateRandomStringFromAlphabetUniform(t *testing.T) {
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	const samples = 640000
+
+	s, err := GenerateRandomStringFromAlphabet(samples, alphabet)
+	if err != nil {
+		t.Fatalf("GenerateRandomStringFromAlphabet() returned error: %v", err)
+	}
+
+	counts := make(map[rune]int, len(alphabet))
+	for _, r := range alphabet {
+		counts[r] = 0
+	}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	expected := float64(samples) / float64(len(alphabet))
+	var chiSquared float64
+	for _, count := range counts {
+		diff := float64(count) - expected
+		chiSquared += diff * diff / expected
+	}
+
+	// Chi-squared critical value for 61 degrees of freedom (len(alphabet)-1, for
+	// this 62-character alphabet) at p=0.001 is ~100.9; a correctly-uniform
+	// generator will very rarely exceed it.
+	const criticalValue = 100.9
+	if chiSquared > criticalValue {
+		t.Errorf("chi-squared statistic %.2f exceeds critical value %.2f; "+
+			"distribution is not uniform", chiSquared, criticalValue)
+	}
+}
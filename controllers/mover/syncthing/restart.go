@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package syncthing
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/backube/volsync/api/v1alpha1"
+	"github.com/backube/volsync/controllers/mover/syncthing/api"
+	"github.com/syncthing/syncthing/lib/config"
+)
+
+// peerInstanceID derives an identifier for a remote Syncthing process that
+// stays stable for the lifetime of that process, but changes the moment it
+// restarts -- mirroring the random per-process instance ID Syncthing itself
+// broadcasts during local discovery.
+func peerInstanceID(conn api.Connection) string {
+	return fmt.Sprintf("%s@%s", conn.ClientVersion, conn.StartedAt.Format("2006-01-02T15:04:05.000000000Z07:00"))
+}
+
+// detectPeerRestarts fetches the local Syncthing instance's current connections
+// and compares each connected peer's instance ID against previousStatus, the
+// status we recorded on the last reconcile. It returns the device IDs of any
+// peer whose instance ID changed -- almost always because that peer's pod was
+// rescheduled and came back up with a fresh Syncthing process -- along with the
+// up-to-date status to persist for the next reconcile. A peer that isn't
+// currently connected keeps its last-known instance ID in currentStatus, since
+// a rescheduled pod almost always passes through an observable disconnect
+// before reconnecting, and dropping its instance ID there would make the
+// reconnect look like a first observation instead of a restart. Entries for
+// peers no longer present in peerList are dropped rather than carried
+// forward, so a churning mesh doesn't grow the persisted status without
+// bound over the object's lifetime.
+func detectPeerRestarts(
+	syncthing *api.Syncthing,
+	peerList []v1alpha1.SyncthingPeer,
+	previousStatus []v1alpha1.SyncthingPeerStatus,
+) (restarted []string, currentStatus []v1alpha1.SyncthingPeerStatus, err error) {
+	connections, err := syncthing.SystemConnections()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desired := make(map[string]bool, len(peerList))
+	for _, peer := range peerList {
+		desired[peer.ID] = true
+	}
+
+	previous := make(map[string]string, len(previousStatus))
+	for _, status := range previousStatus {
+		previous[status.ID] = status.InstanceID
+	}
+
+	seen := make(map[string]bool, len(connections))
+	for deviceID, conn := range connections {
+		if !conn.Connected || !desired[deviceID] {
+			continue
+		}
+		seen[deviceID] = true
+		instanceID := peerInstanceID(conn)
+		currentStatus = append(currentStatus, v1alpha1.SyncthingPeerStatus{ID: deviceID, InstanceID: instanceID})
+		if prevInstanceID, ok := previous[deviceID]; ok && prevInstanceID != instanceID {
+			restarted = append(restarted, deviceID)
+		}
+	}
+	for _, status := range previousStatus {
+		if !seen[status.ID] && desired[status.ID] {
+			currentStatus = append(currentStatus, status)
+		}
+	}
+	return restarted, currentStatus, nil
+}
+
+// ReconcilePeerRestarts re-pushes our device configuration immediately, instead
+// of waiting for the next scheduled reconcile, whenever a connected peer's
+// instance ID has changed since we last looked. A Kubernetes event is emitted
+// for each restarted peer so operators can see the mesh re-establishing without
+// digging through logs. It returns the peer status to persist on the owning
+// CR, whether or not any peer had restarted.
+func ReconcilePeerRestarts(
+	peerList []v1alpha1.SyncthingPeer,
+	syncthing *api.Syncthing,
+	previousStatus []v1alpha1.SyncthingPeerStatus,
+	recorder record.EventRecorder,
+	owner runtime.Object,
+) ([]v1alpha1.SyncthingPeerStatus, error) {
+	restarted, currentStatus, err := detectPeerRestarts(syncthing, peerList, previousStatus)
+	if err != nil {
+		return nil, err
+	}
+	if len(restarted) == 0 {
+		return currentStatus, nil
+	}
+
+	if err := updateSyncthingDevices(peerList, syncthing); err != nil {
+		return nil, err
+	}
+	// updateSyncthingDevices only pushes devices that differ from the running
+	// configuration, so push the restarted peers' entries explicitly.
+	isRestarted := make(map[string]bool, len(restarted))
+	for _, deviceID := range restarted {
+		isRestarted[deviceID] = true
+	}
+	var forced api.DeviceDelta
+	for _, device := range syncthing.Configuration.Devices {
+		if isRestarted[device.DeviceID.GoString()] {
+			forced.Update = append(forced.Update, device)
+		}
+	}
+	if err := syncthing.ApplyDeviceDelta(forced); err != nil {
+		return nil, err
+	}
+
+	for _, deviceID := range restarted {
+		recorder.Eventf(owner, corev1.EventTypeNormal, "SyncthingPeerRestarted",
+			"Syncthing peer %s appears to have restarted; re-pushed device configuration", deviceID)
+	}
+	return currentStatus, nil
+}
+
+// announcedDeviceName returns the name we advertise for ourselves to
+// Syncthing peers, embedding our own InstanceID so that remote VolSync
+// instances can recognize a restart of ours from the name alone.
+func announcedDeviceName(syncthing *api.Syncthing) string {
+	return fmt.Sprintf("volsync-%s", syncthing.InstanceID)
+}
+
+// updateSyncthingOwnDeviceName updates our own entry in Configuration.Devices,
+// if present, so that its announced Name includes our InstanceID. It returns
+// the (possibly updated) device and whether a rename actually happened, so
+// callers can fold the rename into a device delta without re-diffing it.
+func updateSyncthingOwnDeviceName(syncthing *api.Syncthing) (device config.DeviceConfiguration, renamed bool) {
+	myID := syncthing.MyID()
+	name := announcedDeviceName(syncthing)
+	for i := range syncthing.Configuration.Devices {
+		if syncthing.Configuration.Devices[i].DeviceID.GoString() != myID {
+			continue
+		}
+		if syncthing.Configuration.Devices[i].Name == name {
+			return syncthing.Configuration.Devices[i], false
+		}
+		syncthing.Configuration.Devices[i].Name = name
+		return syncthing.Configuration.Devices[i], true
+	}
+	return config.DeviceConfiguration{}, false
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package syncthing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/backube/volsync/api/v1alpha1"
+	"github.com/backube/volsync/controllers/mover/syncthing/api"
+)
+
+// newTestSyncthingServer starts an httptest.Server that serves a mutable
+// "/rest/system/connections" response -- tests can reassign *connections
+// between calls to detectPeerRestarts to simulate a peer connecting,
+// disconnecting, and reconnecting -- and returns an api.Syncthing configured
+// to talk to it.
+func newTestSyncthingServer(t *testing.T, connections map[string]api.Connection) (*api.Syncthing, *map[string]api.Connection, func()) {
+	t.Helper()
+
+	current := connections
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/system/connections", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"connections": current})
+	})
+	server := httptest.NewServer(mux)
+
+	syncthing := &api.Syncthing{
+		DeviceID:  testDeviceID("self"),
+		APIConfig: api.APIConfig{Endpoint: server.URL, APIKey: "test-key"},
+	}
+	return syncthing, &current, server.Close
+}
+
+func TestDetectPeerRestarts(t *testing.T) {
+	peerA := testDeviceID("peer-a").GoString()
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restarted := started.Add(time.Hour)
+
+	defaultPeerList := []v1alpha1.SyncthingPeer{{ID: peerA}}
+
+	tests := []struct {
+		name              string
+		peerList          []v1alpha1.SyncthingPeer
+		connections       map[string]api.Connection
+		previous          []v1alpha1.SyncthingPeerStatus
+		wantRestarted     []string
+		wantCurrentStatus []v1alpha1.SyncthingPeerStatus
+	}{
+		{
+			name:     "first observation is not a restart",
+			peerList: defaultPeerList,
+			connections: map[string]api.Connection{
+				peerA: {ClientVersion: "v1.27.0", StartedAt: started, Connected: true},
+			},
+			wantRestarted: nil,
+		},
+		{
+			name:     "unchanged instance ID is not a restart",
+			peerList: defaultPeerList,
+			connections: map[string]api.Connection{
+				peerA: {ClientVersion: "v1.27.0", StartedAt: started, Connected: true},
+			},
+			previous: []v1alpha1.SyncthingPeerStatus{
+				{ID: peerA, InstanceID: peerInstanceID(api.Connection{ClientVersion: "v1.27.0", StartedAt: started})},
+			},
+			wantRestarted: nil,
+		},
+		{
+			name:     "new StartedAt is a restart",
+			peerList: defaultPeerList,
+			connections: map[string]api.Connection{
+				peerA: {ClientVersion: "v1.27.0", StartedAt: restarted, Connected: true},
+			},
+			previous: []v1alpha1.SyncthingPeerStatus{
+				{ID: peerA, InstanceID: peerInstanceID(api.Connection{ClientVersion: "v1.27.0", StartedAt: started})},
+			},
+			wantRestarted: []string{peerA},
+		},
+		{
+			name:     "disconnected peers are ignored, but their instance ID is carried forward",
+			peerList: defaultPeerList,
+			connections: map[string]api.Connection{
+				peerA: {ClientVersion: "v1.27.0", StartedAt: restarted, Connected: false},
+			},
+			previous: []v1alpha1.SyncthingPeerStatus{
+				{ID: peerA, InstanceID: peerInstanceID(api.Connection{ClientVersion: "v1.27.0", StartedAt: started})},
+			},
+			wantRestarted: nil,
+			wantCurrentStatus: []v1alpha1.SyncthingPeerStatus{
+				{ID: peerA, InstanceID: peerInstanceID(api.Connection{ClientVersion: "v1.27.0", StartedAt: started})},
+			},
+		},
+		{
+			name:     "peer removed from peerList is dropped instead of carried forward",
+			peerList: nil,
+			connections: map[string]api.Connection{
+				peerA: {ClientVersion: "v1.27.0", StartedAt: restarted, Connected: false},
+			},
+			previous: []v1alpha1.SyncthingPeerStatus{
+				{ID: peerA, InstanceID: peerInstanceID(api.Connection{ClientVersion: "v1.27.0", StartedAt: started})},
+			},
+			wantRestarted:     nil,
+			wantCurrentStatus: []v1alpha1.SyncthingPeerStatus{},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			syncthing, _, closeServer := newTestSyncthingServer(t, tt.connections)
+			defer closeServer()
+
+			restarted, currentStatus, err := detectPeerRestarts(syncthing, tt.peerList, tt.previous)
+			if err != nil {
+				t.Fatalf("detectPeerRestarts() returned error: %v", err)
+			}
+			if len(restarted) != len(tt.wantRestarted) {
+				t.Fatalf("detectPeerRestarts() restarted = %v, want %v", restarted, tt.wantRestarted)
+			}
+			for i, id := range tt.wantRestarted {
+				if restarted[i] != id {
+					t.Errorf("detectPeerRestarts() restarted[%d] = %v, want %v", i, restarted[i], id)
+				}
+			}
+			if tt.wantCurrentStatus != nil {
+				if len(currentStatus) != len(tt.wantCurrentStatus) {
+					t.Fatalf("detectPeerRestarts() currentStatus = %v, want %v", currentStatus, tt.wantCurrentStatus)
+				}
+				for _, want := range tt.wantCurrentStatus {
+					found := false
+					for _, got := range currentStatus {
+						if got == want {
+							found = true
+							break
+						}
+					}
+					if !found {
+						t.Errorf("detectPeerRestarts() currentStatus = %v, want to contain %v", currentStatus, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDetectPeerRestartsAcrossDisconnect checks the common real-world sequence
+// for a rescheduled pod: the peer is observed connected, then disconnected,
+// then reconnects with a new instance ID. The restart must still be detected
+// even though an intervening reconcile saw the peer disconnected.
+func TestDetectPeerRestartsAcrossDisconnect(t *testing.T) {
+	peerA := testDeviceID("peer-a").GoString()
+	peerList := []v1alpha1.SyncthingPeer{{ID: peerA}}
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restartedAt := started.Add(time.Hour)
+
+	syncthing, connections, closeServer := newTestSyncthingServer(t, map[string]api.Connection{
+		peerA: {ClientVersion: "v1.27.0", StartedAt: started, Connected: true},
+	})
+	defer closeServer()
+
+	_, status, err := detectPeerRestarts(syncthing, peerList, nil)
+	if err != nil {
+		t.Fatalf("detectPeerRestarts() returned error: %v", err)
+	}
+
+	*connections = map[string]api.Connection{
+		peerA: {ClientVersion: "v1.27.0", StartedAt: started, Connected: false},
+	}
+	restarted, status, err := detectPeerRestarts(syncthing, peerList, status)
+	if err != nil {
+		t.Fatalf("detectPeerRestarts() returned error: %v", err)
+	}
+	if len(restarted) != 0 {
+		t.Fatalf("detectPeerRestarts() restarted = %v, want none while disconnected", restarted)
+	}
+
+	*connections = map[string]api.Connection{
+		peerA: {ClientVersion: "v1.27.0", StartedAt: restartedAt, Connected: true},
+	}
+	restarted, _, err = detectPeerRestarts(syncthing, peerList, status)
+	if err != nil {
+		t.Fatalf("detectPeerRestarts() returned error: %v", err)
+	}
+	if len(restarted) != 1 || restarted[0] != peerA {
+		t.Errorf("detectPeerRestarts() restarted = %v, want [%s] after reconnecting with a new instance ID", restarted, peerA)
+	}
+}
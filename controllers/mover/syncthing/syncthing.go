@@ -19,7 +19,10 @@ package syncthing
 import (
 	"crypto/rand"
 	"fmt"
+	"net"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/backube/volsync/api/v1alpha1"
 	"github.com/backube/volsync/controllers/mover/syncthing/api"
@@ -28,94 +31,219 @@ import (
 )
 
 // updateSyncthingDevices Updates the Syncthing's connected devices with the provided peerList.
-// An error may be encountered when reading the DeviceID from a string.
+// An error may be encountered when reading the DeviceID from a string, or when a peer
+// advertises an address using an unsupported scheme. Only the devices that actually
+// differ from the running configuration are pushed through the Syncthing API -- including
+// our own entry if its announced name changed -- so a reconcile over a large,
+// mostly-unchanged peer mesh stays cheap. Listen addresses and folder device shares are
+// pushed through their own dedicated endpoints, independently of the device delta, so
+// callers must not also call ApplyConfiguration, which would re-PATCH the full device
+// list this function already applied incrementally.
 func updateSyncthingDevices(peerList []v1alpha1.SyncthingPeer,
 	syncthing *api.Syncthing) error {
 	if syncthing == nil {
 		return fmt.Errorf("syncthing cannot be nil")
 	}
-	newDevices := []config.DeviceConfiguration{}
-	// add myself and introduced devices to the device list
-	for _, device := range syncthing.Configuration.Devices {
-		if device.DeviceID.GoString() == syncthing.MyID() || device.IntroducedBy.GoString() != "" {
-			newDevices = append(newDevices, device)
-		}
-	}
-	// Add the devices from the peerList to the device list
-	for _, device := range peerList {
-		deviceID, err := protocol.DeviceIDFromString(device.ID)
-		if err != nil {
+	if updateSyncthingListenAddresses(syncthing) {
+		if err := syncthing.ApplyOptions(); err != nil {
 			return err
 		}
-		stDeviceToAdd := config.DeviceConfiguration{
-			DeviceID:   deviceID,
-			Addresses:  []string{device.Address},
-			Introducer: device.Introducer,
-		}
-		newDevices = append(newDevices, stDeviceToAdd)
 	}
+	selfDevice, selfRenamed := updateSyncthingOwnDeviceName(syncthing)
+
+	desired, err := desiredDevices(peerList, syncthing.DeviceID)
+	if err != nil {
+		return err
+	}
+	delta := computeDeviceDelta(desired, currentDevices(syncthing))
+	if selfRenamed {
+		delta.Update = append(delta.Update, selfDevice)
+	}
+	if delta.Empty() {
+		return nil
+	}
+
+	newDevices := mergeDeviceDelta(syncthing.Configuration.Devices, delta)
 	syncthing.Configuration.Devices = newDevices
 	syncthing.ShareFoldersWithDevices(newDevices)
-	return nil
+	if err := syncthing.ApplyDeviceDelta(delta); err != nil {
+		return err
+	}
+	return syncthing.ApplyFolders()
 }
 
-// syncthingNeedsReconfigure Determines whether the given nodeList differs from Syncthing's internal devices,
-// and returns 'true' if the Syncthing API must be reconfigured, 'false' otherwise.
-func syncthingNeedsReconfigure(
-	nodeList []v1alpha1.SyncthingPeer,
-	syncthing *api.Syncthing,
-) bool {
-	// check if the syncthing nodelist diverges from the current syncthing devices
-	var newDevices map[string]v1alpha1.SyncthingPeer = map[string]v1alpha1.SyncthingPeer{
-		// initialize the map with the self node
-		syncthing.MyID(): {
-			ID:      syncthing.MyID(),
-			Address: "",
-		},
-	}
-
-	// add all of the other devices in the provided nodeList
-	for _, device := range nodeList {
-		// avoid self
-		if device.ID == syncthing.MyID() {
+// desiredDevices builds the desired set of Syncthing devices from peerList, keyed by
+// protocol.DeviceID, validating each peer's addresses, allowed networks, and
+// compression setting along the way. myID is excluded, since we never manage
+// ourselves as a peer.
+func desiredDevices(
+	peerList []v1alpha1.SyncthingPeer,
+	myID protocol.DeviceID,
+) (map[protocol.DeviceID]config.DeviceConfiguration, error) {
+	desired := make(map[protocol.DeviceID]config.DeviceConfiguration, len(peerList))
+	for _, peer := range peerList {
+		deviceID, err := protocol.DeviceIDFromString(peer.ID)
+		if err != nil {
+			return nil, err
+		}
+		if deviceID == myID {
 			continue
 		}
-		newDevices[device.ID] = device
-	}
 
-	// create a map for current devices
-	var currentDevs map[string]v1alpha1.SyncthingPeer = map[string]v1alpha1.SyncthingPeer{
-		// initialize the map with the self node
-		syncthing.MyID(): {
-			ID:      syncthing.MyID(),
-			Address: "",
-		},
+		addresses := make([]string, 0, len(peer.Addresses))
+		for _, address := range peer.Addresses {
+			validAddress, err := asSyncthingAddress(address)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: %w", peer.ID, err)
+			}
+			addresses = append(addresses, validAddress)
+		}
+		if err := validateAllowedNetworks(peer.AllowedNetworks); err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer.ID, err)
+		}
+		compression, err := compressionFor(peer.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer.ID, err)
+		}
+
+		desired[deviceID] = config.DeviceConfiguration{
+			DeviceID:        deviceID,
+			Addresses:       addresses,
+			Introducer:      peer.Introducer,
+			AllowedNetworks: peer.AllowedNetworks,
+			Compression:     compression,
+		}
 	}
-	// add the rest of devices to the map
+	return desired, nil
+}
+
+// currentDevices indexes Syncthing's running device list by protocol.DeviceID,
+// excluding ourselves and any device we only know about because another device
+// introduced it to us.
+func currentDevices(syncthing *api.Syncthing) map[protocol.DeviceID]config.DeviceConfiguration {
+	current := make(map[protocol.DeviceID]config.DeviceConfiguration, len(syncthing.Configuration.Devices))
 	for _, device := range syncthing.Configuration.Devices {
-		// ignore self and introduced devices
-		if device.DeviceID.GoString() == syncthing.MyID() || device.IntroducedBy.GoString() != "" {
+		if device.DeviceID == syncthing.DeviceID || device.IntroducedBy.GoString() != "" {
 			continue
 		}
+		current[device.DeviceID] = device
+	}
+	return current
+}
 
-		currentDevs[device.DeviceID.GoString()] = v1alpha1.SyncthingPeer{
-			ID:      device.DeviceID.GoString(),
-			Address: device.Addresses[0],
+// computeDeviceDelta compares desired against current and returns the additions,
+// updates, and removals needed to reconcile them. A device present in both maps
+// with an identical fingerprint requires no change.
+func computeDeviceDelta(
+	desired, current map[protocol.DeviceID]config.DeviceConfiguration,
+) api.DeviceDelta {
+	var delta api.DeviceDelta
+	for id, device := range desired {
+		existing, ok := current[id]
+		if !ok {
+			delta.Add = append(delta.Add, device)
+			continue
+		}
+		if fingerprintDevice(device) != fingerprintDevice(existing) {
+			delta.Update = append(delta.Update, device)
 		}
 	}
-
-	// check if the syncthing nodelist diverges from the current syncthing devices
-	for _, device := range newDevices {
-		if _, ok := currentDevs[device.ID]; !ok {
-			return true
+	for id := range current {
+		if _, ok := desired[id]; !ok {
+			delta.Remove = append(delta.Remove, id)
 		}
 	}
-	for _, device := range currentDevs {
-		if _, ok := newDevices[device.ID]; !ok {
-			return true
+	return delta
+}
+
+// mergeDeviceDelta applies delta to devices -- Syncthing's full, current device
+// list, including ourselves and any introduced devices -- and returns the
+// resulting list.
+func mergeDeviceDelta(devices []config.DeviceConfiguration, delta api.DeviceDelta) []config.DeviceConfiguration {
+	updated := make(map[protocol.DeviceID]config.DeviceConfiguration, len(delta.Update))
+	for _, device := range delta.Update {
+		updated[device.DeviceID] = device
+	}
+	removed := make(map[protocol.DeviceID]bool, len(delta.Remove))
+	for _, id := range delta.Remove {
+		removed[id] = true
+	}
+
+	merged := make([]config.DeviceConfiguration, 0, len(devices)+len(delta.Add))
+	for _, device := range devices {
+		if removed[device.DeviceID] {
+			continue
+		}
+		if replacement, ok := updated[device.DeviceID]; ok {
+			merged = append(merged, replacement)
+			continue
 		}
+		merged = append(merged, device)
 	}
-	return false
+	return append(merged, delta.Add...)
+}
+
+// defaultListenAddresses are the addresses this mover's local Syncthing instance
+// listens on for incoming connections, so that it remains reachable whether a peer
+// dials in over plain TCP or QUIC.
+var defaultListenAddresses = []string{"tcp://0.0.0.0:22000", "quic://0.0.0.0:22000"}
+
+// updateSyncthingListenAddresses ensures the local Syncthing instance listens for
+// incoming connections over both TCP and QUIC, returning whether the running
+// configuration actually needed to change.
+func updateSyncthingListenAddresses(syncthing *api.Syncthing) bool {
+	if sortedJoin(syncthing.Configuration.Options.ListenAddresses) == sortedJoin(defaultListenAddresses) {
+		return false
+	}
+	syncthing.Configuration.Options.ListenAddresses = defaultListenAddresses
+	return true
+}
+
+// peerFingerprint is a canonical, order-independent snapshot of the
+// reconfigurable attributes of a Syncthing device. Two peers with equal
+// fingerprints are considered in-sync, regardless of the order in which
+// their addresses or allowed networks were listed.
+type peerFingerprint struct {
+	addresses       string
+	introducer      bool
+	compression     protocol.Compression
+	allowedNetworks string
+}
+
+// fingerprintDevice builds a peerFingerprint from a Syncthing device
+// configuration, whether it came from the desired peerList or from Syncthing's
+// own running configuration, so the two can be compared directly.
+func fingerprintDevice(device config.DeviceConfiguration) peerFingerprint {
+	return peerFingerprint{
+		addresses:       sortedJoin(device.Addresses),
+		introducer:      device.Introducer,
+		compression:     device.Compression,
+		allowedNetworks: sortedJoin(device.AllowedNetworks),
+	}
+}
+
+// sortedJoin sorts values and joins them with a separator that cannot appear in
+// a device address or CIDR, producing a stable, comparable key.
+func sortedJoin(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x00")
+}
+
+// syncthingNeedsReconfigure Determines whether the given nodeList differs from Syncthing's internal
+// devices, and returns 'true' if the Syncthing API must be reconfigured, 'false' otherwise. Drift in
+// a peer's addresses, introducer flag, compression setting, or allowed networks is detected, not just
+// additions or removals of a device ID.
+func syncthingNeedsReconfigure(
+	nodeList []v1alpha1.SyncthingPeer,
+	syncthing *api.Syncthing,
+) bool {
+	desired, err := desiredDevices(nodeList, syncthing.DeviceID)
+	if err != nil {
+		// an invalid peer can never already match the running configuration
+		return true
+	}
+	return !computeDeviceDelta(desired, currentDevices(syncthing)).Empty()
 }
 
 // GenerateRandomBytes Generates random bytes of the given length using the OS's RNG.
@@ -129,42 +257,120 @@ func GenerateRandomBytes(length int) ([]byte, error) {
 	return b, nil
 }
 
+// defaultAlphabet is the 94-character printable ASCII alphabet used by
+// GenerateRandomString: everything from "!" (33) to "~" (126) inclusive,
+// excluding control characters 0-31, 32 (space), and 127 (DEL).
+const defaultAlphabet = "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~"
+
 // GenerateRandomString Generates a random string of ASCII characters excluding control characters
-// 0-31, 32 (space), and 127.
-// the given length using the OS's RNG.
+// 0-31, 32 (space), and 127, of the given length, using the OS's RNG.
 func GenerateRandomString(length int) (string, error) {
-	// generate a random string
-	b, err := GenerateRandomBytes(length)
-	if err != nil {
-		return "", err
+	return GenerateRandomStringFromAlphabet(length, defaultAlphabet)
+}
+
+// GenerateRandomStringFromAlphabet generates a random string of the given length,
+// drawing each character uniformly from alphabet using the OS's RNG.
+//
+// Mapping a random byte onto the alphabet with a plain modulo (b % len(alphabet))
+// is biased whenever len(alphabet) does not evenly divide 256: the characters at
+// the start of the alphabet end up over-represented. We instead use rejection
+// sampling: any byte greater than or equal to the largest multiple of
+// len(alphabet) that fits in a byte is discarded, and we keep drawing until we
+// have length accepted bytes.
+func GenerateRandomStringFromAlphabet(length int, alphabet string) (string, error) {
+	if len(alphabet) == 0 {
+		return "", fmt.Errorf("alphabet must not be empty")
+	}
+	if len(alphabet) > 256 {
+		return "", fmt.Errorf("alphabet must not exceed 256 characters")
 	}
 
-	// construct string by mapping the randomly generated bytes into
-	// a range of acceptable characters
-	var lowerBound byte = 33
-	var upperBound byte = 126
-	var acceptableRange = upperBound - lowerBound + 1
+	threshold := 256 - 256%len(alphabet)
 
-	// generate the string by mapping [0, 255] -> [33, 126]
-	var acceptableBytes = []byte{}
-	for i := 0; i < len(b); i++ {
-		// normalize number to be in the range [33, 126] inclusive
-		acceptableByte := (b[i] % acceptableRange) + lowerBound
-		acceptableBytes = append(acceptableBytes, acceptableByte)
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		b, err := GenerateRandomBytes(length - len(result))
+		if err != nil {
+			return "", err
+		}
+		for _, candidate := range b {
+			if int(candidate) >= threshold {
+				continue
+			}
+			result = append(result, alphabet[int(candidate)%len(alphabet)])
+			if len(result) == length {
+				break
+			}
+		}
 	}
-	return string(acceptableBytes), nil
+	return string(result), nil
 }
 
-// asTCPAddress Accepts an address of some form and returns it with a TCP prefix if none exist yet.//
-// If the address already contains a prefix, then it is simply returned.
+// syncthingAddressSchemes enumerates the address schemes Syncthing accepts for a
+// device's Addresses list.
+var syncthingAddressSchemes = []string{"tcp://", "quic://", "relay://", "dynamic+https://"}
+
+// syncthingAddressPattern matches an address of the form "scheme://rest", where
+// "scheme" may itself contain a "+" (e.g. "dynamic+https").
+var syncthingAddressPattern = regexp.MustCompile(`^([\w+]+):\/\/[^\s]+$`)
+
+// asSyncthingAddress validates and normalizes a single peer address entry.
+// A bare "host:port" is assumed to use the "tcp://" scheme, for backwards
+// compatibility. The literal sentinel "dynamic" is passed through unchanged, as
+// is any address already bearing one of Syncthing's supported schemes: "tcp://",
+// "quic://", "relay://", or "dynamic+https://". Any other scheme is rejected, as
+// is the empty string, which is not a meaningful host:port.
 //
 // See: https://forum.syncthing.net/t/specifying-protocols-without-global-announce-or-relay/18565
-func asTCPAddress(address string) string {
-	// ignore if a prefix already exists
-	uriPattern := regexp.MustCompile(`^(\w+:\/\/)[^\s]+$`)
-	if uriPattern.MatchString(address) {
-		return address
+func asSyncthingAddress(address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("address cannot be empty")
+	}
+	if address == "dynamic" {
+		return address, nil
+	}
+
+	matches := syncthingAddressPattern.FindStringSubmatch(address)
+	if matches == nil {
+		if strings.Contains(address, "://") {
+			return "", fmt.Errorf("malformed syncthing address %q", address)
+		}
+		// no scheme present; assume a bare host:port over TCP
+		return "tcp://" + address, nil
 	}
 
-	return "tcp://" + address
+	scheme := matches[1] + "://"
+	for _, valid := range syncthingAddressSchemes {
+		if scheme == valid {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported syncthing address scheme %q in address %q", scheme, address)
+}
+
+// validateAllowedNetworks checks that every entry of a peer's AllowedNetworks is a
+// syntactically valid CIDR, e.g. "10.0.0.0/8".
+func validateAllowedNetworks(allowedNetworks []string) error {
+	for _, network := range allowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("invalid allowedNetworks entry %q: %w", network, err)
+		}
+	}
+	return nil
+}
+
+// compressionFor maps a SyncthingPeer's Compression setting ("metadata", "always",
+// "never", or the empty string) to Syncthing's protocol.Compression enum. An empty
+// string defaults to protocol.CompressionMetadata, matching Syncthing's own default.
+func compressionFor(compression string) (protocol.Compression, error) {
+	switch compression {
+	case "", "metadata":
+		return protocol.CompressionMetadata, nil
+	case "always":
+		return protocol.CompressionAlways, nil
+	case "never":
+		return protocol.CompressionNever, nil
+	default:
+		return 0, fmt.Errorf("unsupported compression setting %q", compression)
+	}
 }
\ No newline at end of file
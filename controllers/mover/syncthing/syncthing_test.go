@@ -0,0 +1,532 @@
+/*
+Copyright 2022 The VolSync authors.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package syncthing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/backube/volsync/api/v1alpha1"
+	"github.com/backube/volsync/controllers/mover/syncthing/api"
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// testDeviceID deterministically derives a protocol.DeviceID from a seed string,
+// so tests can refer to peers by a readable name.
+func testDeviceID(seed string) protocol.DeviceID {
+	return protocol.NewDeviceID([]byte(seed))
+}
+
+func TestSyncthingNeedsReconfigure(t *testing.T) {
+	self := testDeviceID("self")
+	peerA := testDeviceID("peer-a")
+	peerB := testDeviceID("peer-b")
+
+	tests := []struct {
+		name            string
+		peerList        []v1alpha1.SyncthingPeer
+		devices         []config.DeviceConfiguration
+		wantReconfigure bool
+	}{
+		{
+			name: "no devices, no peers",
+		},
+		{
+			name: "matching single peer",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), Addresses: []string{"tcp://1.2.3.4:22000"}},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Addresses: []string{"tcp://1.2.3.4:22000"}, Compression: protocol.CompressionMetadata},
+			},
+		},
+		{
+			name: "addresses reordered does not require reconfigure",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), Addresses: []string{"tcp://1.2.3.4:22000", "quic://1.2.3.4:22000"}},
+			},
+			devices: []config.DeviceConfiguration{
+				{
+					DeviceID:    peerA,
+					Addresses:   []string{"quic://1.2.3.4:22000", "tcp://1.2.3.4:22000"},
+					Compression: protocol.CompressionMetadata,
+				},
+			},
+		},
+		{
+			name: "address changed",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), Addresses: []string{"tcp://1.2.3.4:22000"}},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Addresses: []string{"tcp://5.6.7.8:22000"}, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "introducer changed",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), Introducer: true},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Introducer: false, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "compression changed",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), Compression: "always"},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "allowed networks changed",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), AllowedNetworks: []string{"10.0.0.0/8"}},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, AllowedNetworks: []string{"192.168.1.0/24"}, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "allowed networks reordered does not require reconfigure",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString(), AllowedNetworks: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+			},
+			devices: []config.DeviceConfiguration{
+				{
+					DeviceID:        peerA,
+					AllowedNetworks: []string{"192.168.1.0/24", "10.0.0.0/8"},
+					Compression:     protocol.CompressionMetadata,
+				},
+			},
+		},
+		{
+			name: "peer added",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString()},
+				{ID: peerB.GoString()},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "peer removed",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString()},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				{DeviceID: peerB, Compression: protocol.CompressionMetadata},
+			},
+			wantReconfigure: true,
+		},
+		{
+			name: "introduced devices are ignored",
+			peerList: []v1alpha1.SyncthingPeer{
+				{ID: peerA.GoString()},
+			},
+			devices: []config.DeviceConfiguration{
+				{DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				{DeviceID: peerB, IntroducedBy: peerA, Compression: protocol.CompressionMetadata},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			syncthing := &api.Syncthing{
+				DeviceID:      self,
+				Configuration: config.Configuration{Devices: tt.devices},
+			}
+			if got := syncthingNeedsReconfigure(tt.peerList, syncthing); got != tt.wantReconfigure {
+				t.Errorf("syncthingNeedsReconfigure() = %v, want %v", got, tt.wantReconfigure)
+			}
+		})
+	}
+}
+
+// TestComputeDeviceDelta checks that reconciling a peer mesh only ever touches
+// the devices that actually changed, regardless of how many devices are
+// already up to date -- the delta must stay proportional to what changed, not
+// to the size of the mesh.
+func TestComputeDeviceDelta(t *testing.T) {
+	peerA := testDeviceID("peer-a")
+	peerB := testDeviceID("peer-b")
+	peerC := testDeviceID("peer-c")
+
+	tests := []struct {
+		name       string
+		desired    map[protocol.DeviceID]config.DeviceConfiguration
+		current    map[protocol.DeviceID]config.DeviceConfiguration
+		wantAdd    []protocol.DeviceID
+		wantUpdate []protocol.DeviceID
+		wantRemove []protocol.DeviceID
+	}{
+		{
+			name: "unchanged large mesh produces an empty delta",
+			desired: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			current: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+		},
+		{
+			name: "one new peer in a large mesh only adds that peer",
+			desired: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			current: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Compression: protocol.CompressionMetadata},
+			},
+			wantAdd: []protocol.DeviceID{peerC},
+		},
+		{
+			name: "one changed peer in a large mesh only updates that peer",
+			desired: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Addresses: []string{"tcp://5.6.7.8:22000"}, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			current: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Addresses: []string{"tcp://1.2.3.4:22000"}, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			wantUpdate: []protocol.DeviceID{peerB},
+		},
+		{
+			name: "one removed peer in a large mesh only removes that peer",
+			desired: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			current: map[protocol.DeviceID]config.DeviceConfiguration{
+				peerA: {DeviceID: peerA, Compression: protocol.CompressionMetadata},
+				peerB: {DeviceID: peerB, Compression: protocol.CompressionMetadata},
+				peerC: {DeviceID: peerC, Compression: protocol.CompressionMetadata},
+			},
+			wantRemove: []protocol.DeviceID{peerB},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			delta := computeDeviceDelta(tt.desired, tt.current)
+			if got := deviceIDs(delta.Add); !sameIDs(got, tt.wantAdd) {
+				t.Errorf("computeDeviceDelta() Add = %v, want %v", got, tt.wantAdd)
+			}
+			if got := deviceIDs(delta.Update); !sameIDs(got, tt.wantUpdate) {
+				t.Errorf("computeDeviceDelta() Update = %v, want %v", got, tt.wantUpdate)
+			}
+			if !sameIDs(delta.Remove, tt.wantRemove) {
+				t.Errorf("computeDeviceDelta() Remove = %v, want %v", delta.Remove, tt.wantRemove)
+			}
+		})
+	}
+}
+
+// fakeSyncthingDeviceServerCalls tallies how many times each REST endpoint
+// newFakeSyncthingDeviceServer recognizes was hit.
+type fakeSyncthingDeviceServerCalls struct {
+	devicePuts, deviceDeletes int32
+	optionPuts, folderPuts    int32
+	configPatches             int32
+}
+
+// newFakeSyncthingDeviceServer starts an in-process fake of the Syncthing REST
+// API's device, options, and folders endpoints, counting calls to each so
+// tests can assert a reconcile only issues the handful of targeted calls its
+// delta actually needs, never falling back to a full "/rest/config" PATCH.
+func newFakeSyncthingDeviceServer(t *testing.T) (server *httptest.Server, calls *fakeSyncthingDeviceServerCalls) {
+	t.Helper()
+	calls = &fakeSyncthingDeviceServerCalls{}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/rest/config/devices/"):
+			atomic.AddInt32(&calls.devicePuts, 1)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/rest/config/devices/"):
+			atomic.AddInt32(&calls.deviceDeletes, 1)
+		case r.Method == http.MethodPut && r.URL.Path == "/rest/config/options":
+			atomic.AddInt32(&calls.optionPuts, 1)
+		case r.Method == http.MethodPut && r.URL.Path == "/rest/config/folders":
+			atomic.AddInt32(&calls.folderPuts, 1)
+		case r.Method == http.MethodPatch && r.URL.Path == "/rest/config":
+			atomic.AddInt32(&calls.configPatches, 1)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+// meshOfPeers builds a hub-and-spoke fixture of meshSize synthetic peers, all
+// already in sync with the running configuration, then drifts exactly three of
+// them -- one changed address, one removal, one addition -- so every call
+// exercises the same fixed-size delta regardless of meshSize.
+func meshOfPeers(meshSize int) (peerList []v1alpha1.SyncthingPeer, devices []config.DeviceConfiguration) {
+	self := testDeviceID("self")
+	devices = []config.DeviceConfiguration{{DeviceID: self, Compression: protocol.CompressionMetadata}}
+	for i := 0; i < meshSize; i++ {
+		id := testDeviceID(fmt.Sprintf("peer-%d", i))
+		peerList = append(peerList, v1alpha1.SyncthingPeer{
+			ID:          id.GoString(),
+			Addresses:   []string{"tcp://10.0.0.1:22000"},
+			Compression: "metadata",
+		})
+		devices = append(devices, config.DeviceConfiguration{
+			DeviceID:    id,
+			Addresses:   []string{"tcp://10.0.0.1:22000"},
+			Compression: protocol.CompressionMetadata,
+		})
+	}
+
+	peerList[0].Addresses = []string{"tcp://10.0.0.2:22000"} // update
+	peerList = peerList[:len(peerList)-1]                    // removal
+	peerList = append(peerList, v1alpha1.SyncthingPeer{      // addition
+		ID: testDeviceID("peer-new").GoString(), Compression: "metadata",
+	})
+	return peerList, devices
+}
+
+// TestUpdateSyncthingDevicesAtScale drives updateSyncthingDevices against an
+// in-process fake Syncthing API over a hub-and-spoke mesh of 100-500 peers --
+// the scale this was written to handle -- where only three peers actually
+// changed since the last reconcile. It asserts the number of REST calls issued
+// stays fixed at the size of the delta regardless of mesh size, to guard
+// against a regression back to re-serializing and PUTting the full device
+// list, and records allocations at each mesh size so a regression to
+// worse-than-linear scaling shows up as a growing ratio between them.
+func TestUpdateSyncthingDevicesAtScale(t *testing.T) {
+	const baseMesh, scaledMesh = 100, 500
+	allocsBySize := make(map[int]float64, 2)
+
+	for _, meshSize := range []int{baseMesh, scaledMesh} {
+		meshSize := meshSize
+		t.Run(fmt.Sprintf("mesh of %d peers", meshSize), func(t *testing.T) {
+			self := testDeviceID("self")
+			peerList, devices := meshOfPeers(meshSize)
+			server, calls := newFakeSyncthingDeviceServer(t)
+
+			syncthing := &api.Syncthing{
+				DeviceID:      self,
+				APIConfig:     api.APIConfig{Endpoint: server.URL, APIKey: "test-key"},
+				Configuration: config.Configuration{Devices: devices},
+			}
+			// Our own device is already announced under its current name, so this
+			// reconcile's delta is driven entirely by the peer mesh, not a self-rename.
+			syncthing.Configuration.Devices[0].Name = announcedDeviceName(syncthing)
+
+			allocsBySize[meshSize] = testing.AllocsPerRun(1, func() {
+				if err := updateSyncthingDevices(peerList, syncthing); err != nil {
+					t.Fatalf("updateSyncthingDevices() returned error: %v", err)
+				}
+			})
+
+			// AllocsPerRun(1, ...) runs the body twice -- an unmeasured warm-up plus
+			// the measured run -- and the warm-up already brings devices, options,
+			// and folders fully in sync, so every one of these calls happens exactly
+			// once in total regardless of mesh size or how many times the body ran.
+			if got, want := atomic.LoadInt32(&calls.devicePuts), int32(2); got != want {
+				t.Errorf("device PUT calls = %d, want %d (1 update + 1 add), regardless of mesh size %d", got, want, meshSize)
+			}
+			if got, want := atomic.LoadInt32(&calls.deviceDeletes), int32(1); got != want {
+				t.Errorf("device DELETE calls = %d, want %d, regardless of mesh size %d", got, want, meshSize)
+			}
+			if got, want := atomic.LoadInt32(&calls.optionPuts), int32(1); got != want {
+				t.Errorf("PUT /rest/config/options calls = %d, want %d, regardless of mesh size %d", got, want, meshSize)
+			}
+			if got, want := atomic.LoadInt32(&calls.folderPuts), int32(1); got != want {
+				t.Errorf("PUT /rest/config/folders calls = %d, want %d, regardless of mesh size %d", got, want, meshSize)
+			}
+			if got := atomic.LoadInt32(&calls.configPatches); got != 0 {
+				t.Errorf("PATCH /rest/config calls = %d, want 0 -- a device delta must never fall back to a full config replace", got)
+			}
+		})
+	}
+
+	// Rebuilding the desired/current device maps is inherently O(meshSize), so
+	// allocations are expected to grow with mesh size -- but growth must stay
+	// linear: a 5x larger mesh should cost roughly 5x the allocations, not
+	// dramatically more, which would indicate a regression to worse-than-linear
+	// reconciliation cost.
+	const sizeRatio = float64(scaledMesh) / float64(baseMesh)
+	if allocRatio := allocsBySize[scaledMesh] / allocsBySize[baseMesh]; allocRatio > sizeRatio*1.5 {
+		t.Errorf("allocations scaled %.1fx for a %.0fx larger mesh (%.0f -> %.0f allocs), want <= %.1fx",
+			allocRatio, sizeRatio, allocsBySize[baseMesh], allocsBySize[scaledMesh], sizeRatio*1.5)
+	}
+}
+
+// deviceIDs extracts the DeviceID of each device, for comparing against a
+// delta's expected device IDs regardless of map iteration order.
+func deviceIDs(devices []config.DeviceConfiguration) []protocol.DeviceID {
+	ids := make([]protocol.DeviceID, len(devices))
+	for i, device := range devices {
+		ids[i] = device.DeviceID
+	}
+	return ids
+}
+
+// sameIDs reports whether got and want contain the same device IDs,
+// irrespective of order.
+func sameIDs(got, want []protocol.DeviceID) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[protocol.DeviceID]bool, len(want))
+	for _, id := range want {
+		seen[id] = true
+	}
+	for _, id := range got {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAsSyncthingAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{name: "bare host:port defaults to tcp", address: "10.0.0.1:22000", want: "tcp://10.0.0.1:22000"},
+		{name: "explicit tcp scheme passes through", address: "tcp://10.0.0.1:22000", want: "tcp://10.0.0.1:22000"},
+		{name: "quic scheme passes through", address: "quic://10.0.0.1:22000", want: "quic://10.0.0.1:22000"},
+		{name: "relay scheme passes through", address: "relay://relay.example.com:443", want: "relay://relay.example.com:443"},
+		{
+			name:    "dynamic+https scheme passes through",
+			address: "dynamic+https://discovery.example.com",
+			want:    "dynamic+https://discovery.example.com",
+		},
+		{name: "bare dynamic sentinel passes through", address: "dynamic", want: "dynamic"},
+		{name: "unsupported scheme is rejected", address: "http://10.0.0.1:8080", wantErr: true},
+		{name: "unsupported scheme with plus is rejected", address: "relay+udp://10.0.0.1:22000", wantErr: true},
+		{name: "empty address is rejected", address: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := asSyncthingAddress(tt.address)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("asSyncthingAddress(%q) returned nil error, want one", tt.address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("asSyncthingAddress(%q) returned error: %v", tt.address, err)
+			}
+			if got != tt.want {
+				t.Errorf("asSyncthingAddress(%q) = %q, want %q", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowedNetworks []string
+		wantErr         bool
+	}{
+		{name: "nil is valid", allowedNetworks: nil},
+		{name: "valid CIDRs are accepted", allowedNetworks: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{name: "missing prefix length is rejected", allowedNetworks: []string{"10.0.0.0"}, wantErr: true},
+		{name: "out-of-range prefix length is rejected", allowedNetworks: []string{"10.0.0.0/33"}, wantErr: true},
+		{name: "garbage entry is rejected", allowedNetworks: []string{"not-a-cidr"}, wantErr: true},
+		{
+			name:            "one invalid entry among valid ones is still rejected",
+			allowedNetworks: []string{"10.0.0.0/8", "not-a-cidr"},
+			wantErr:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAllowedNetworks(tt.allowedNetworks)
+			if tt.wantErr && err == nil {
+				t.Fatalf("validateAllowedNetworks(%v) returned nil error, want one", tt.allowedNetworks)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("validateAllowedNetworks(%v) returned error: %v", tt.allowedNetworks, err)
+			}
+		})
+	}
+}
+
+func TestCompressionFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		want        protocol.Compression
+		wantErr     bool
+	}{
+		{name: "empty string defaults to metadata", compression: "", want: protocol.CompressionMetadata},
+		{name: "metadata", compression: "metadata", want: protocol.CompressionMetadata},
+		{name: "always", compression: "always", want: protocol.CompressionAlways},
+		{name: "never", compression: "never", want: protocol.CompressionNever},
+		{name: "unsupported value is rejected", compression: "sometimes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := compressionFor(tt.compression)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("compressionFor(%q) returned nil error, want one", tt.compression)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compressionFor(%q) returned error: %v", tt.compression, err)
+			}
+			if got != tt.want {
+				t.Errorf("compressionFor(%q) = %v, want %v", tt.compression, got, tt.want)
+			}
+		})
+	}
+}